@@ -1,35 +1,154 @@
 package builder
 
+import (
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"sort"
+	"strings"
+)
+
 // MultiError is a list of multiple errors (actually: diagnostics) returned
-// during LLVM IR generation.
+// during LLVM IR generation. Diagnostics are sorted by source position (when
+// available) and deduplicated by (position, message), so that both humans
+// reading the output and editors parsing it for problem markers get a
+// stable, minimal list.
 type MultiError struct {
 	Errs []error
+	fset *token.FileSet // used to format positions in Error(); may be nil
 }
 
+// Error renders one line per diagnostic, prefixed with its source position
+// (file:line:col:) when one is available and the diagnostic doesn't already
+// include it (as is the case for *scanner.Error).
 func (e *MultiError) Error() string {
-	// Return the first error, to conform to the error interface. Clients should
-	// really do a type-assertion on *MultiError.
-	return e.Errs[0].Error()
+	lines := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		if _, ok := err.(*scanner.Error); ok {
+			// *scanner.Error already formats its own "file:line:col: msg".
+			lines[i] = err.Error()
+			continue
+		}
+		if pos, ok := diagnosticPosition(err, e.fset); ok {
+			lines[i] = fmt.Sprintf("%s: %s", pos, err.Error())
+		} else {
+			lines[i] = err.Error()
+		}
+	}
+	return strings.Join(lines, "\n")
 }
 
-// newMultiError returns a *MultiError if there is more than one error, or
-// returns that error directly when there is only one. Passing an empty slice
-// will lead to a panic.
-func newMultiError(errs []error) error {
+// Unwrap implements the Go 1.20 multi-error interface, so that
+// errors.Is/errors.As already walk every diagnostic in the bag instead of
+// just the first one, without MultiError needing its own Is/As methods.
+func (e *MultiError) Unwrap() []error {
+	return e.Errs
+}
+
+// posError is implemented by diagnostics that know their own source
+// position but aren't a *scanner.Error (for example, errors created with a
+// token.Pos by the compiler).
+type posError interface {
+	Pos() token.Pos
+}
+
+// diagnosticPosition extracts the source position of a diagnostic, if it
+// has one. It understands both *scanner.Error (which carries a resolved
+// token.Position directly) and any error implementing posError (which
+// carries a token.Pos that still needs resolving against fset).
+func diagnosticPosition(err error, fset *token.FileSet) (token.Position, bool) {
+	if scanErr, ok := err.(*scanner.Error); ok {
+		return scanErr.Pos, true
+	}
+	if posErr, ok := err.(posError); ok && fset != nil {
+		return fset.Position(posErr.Pos()), true
+	}
+	return token.Position{}, false
+}
+
+// newMultiError returns a *MultiError for the given diagnostics, sorted by
+// source position (diagnostics without a resolvable position sort last, in
+// the order they were given) and deduplicated by (position, message). fset
+// is used to resolve positions and to format them in Error(); it may be nil,
+// in which case only diagnostics that carry their own resolved position
+// (*scanner.Error) are sorted, and all others keep their original order
+// after them.
+//
+// Passing a single error returns that error directly, preserving its
+// identity so callers can still type-assert it to e.g. *scanner.Error.
+// Passing an empty slice will lead to a panic.
+func newMultiError(errs []error, fset *token.FileSet) error {
+	errs = dedupeDiagnostics(errs, fset)
+	sort.SliceStable(errs, func(i, j int) bool {
+		posI, okI := diagnosticPosition(errs[i], fset)
+		posJ, okJ := diagnosticPosition(errs[j], fset)
+		if okI != okJ {
+			return okI
+		}
+		if !okI {
+			return false
+		}
+		if posI.Filename != posJ.Filename {
+			return posI.Filename < posJ.Filename
+		}
+		if posI.Line != posJ.Line {
+			return posI.Line < posJ.Line
+		}
+		return posI.Column < posJ.Column
+	})
 	if len(errs) > 1 {
-		return &MultiError{errs}
+		return &MultiError{errs, fset}
 	}
 	return errs[0]
 }
 
-// commandError is an error type to wrap os/exec.Command errors. This provides
-// some more information regarding what went wrong while running a command.
+// dedupeDiagnostics drops diagnostics that have the same source position
+// (or, if neither has one, the same message) and the same message as one
+// already seen, preserving the first occurrence.
+func dedupeDiagnostics(errs []error, fset *token.FileSet) []error {
+	type key struct {
+		pos string
+		msg string
+	}
+	seen := make(map[key]bool, len(errs))
+	result := make([]error, 0, len(errs))
+	for _, err := range errs {
+		pos, _ := diagnosticPosition(err, fset)
+		k := key{pos.String(), err.Error()}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		result = append(result, err)
+	}
+	return result
+}
+
+// commandError is an error type to wrap os/exec.Command errors. This
+// provides some more information regarding what went wrong while running a
+// command, including any diagnostics captured from the command's stderr
+// (for example, one entry per compiler error line for a failing external
+// linker or objcopy invocation).
 type commandError struct {
-	Msg  string
-	File string
-	Err  error
+	Msg    string
+	File   string
+	Err    error
+	Stderr []error
 }
 
 func (e *commandError) Error() string {
-	return e.Msg + " " + e.File + ": " + e.Err.Error()
+	msg := e.Msg + " " + e.File + ": " + e.Err.Error()
+	for _, sub := range e.Stderr {
+		msg += "\n" + sub.Error()
+	}
+	return msg
+}
+
+// Unwrap implements the Go 1.20 multi-error interface: the underlying
+// command error, plus every diagnostic captured from stderr.
+func (e *commandError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Stderr)+1)
+	errs = append(errs, e.Err)
+	errs = append(errs, e.Stderr...)
+	return errs
 }
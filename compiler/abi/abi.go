@@ -0,0 +1,94 @@
+// Package abi implements tinygo's register-based calling convention for
+// expanding small struct parameters into individual call arguments, in the
+// spirit of the register ABI Go itself adopted for amd64/arm64 in 1.17.
+//
+// For background, see:
+// https://tinygo.org/compiler-internals/calling-convention/
+package abi
+
+// RegisterBudget describes how many abstract "registers" are available for
+// argument passing on a given target: one pool for integers and pointers,
+// one pool for floating-point values. These are not necessarily the same as
+// the number of hardware registers the target has, but are chosen to leave
+// enough spare registers for the rest of the calling convention (the
+// context parameter, the coroutine handle, etc).
+type RegisterBudget struct {
+	IntRegisters   int
+	FloatRegisters int
+}
+
+// Budgets for the target families tinygo's calling convention currently
+// distinguishes. Targets not listed here use Default.
+var (
+	AMD64   = RegisterBudget{IntRegisters: 9, FloatRegisters: 15}
+	ARM64   = RegisterBudget{IntRegisters: 16, FloatRegisters: 16}
+	CortexM = RegisterBudget{IntRegisters: 4, FloatRegisters: 4}
+
+	// Default is used for targets that aren't covered by a more specific
+	// budget above. It matches CortexM, which is the most constrained
+	// target tinygo supports and therefore the safest fallback.
+	Default = CortexM
+)
+
+// BudgetForTarget returns the register budget to use for the given LLVM
+// target triple.
+func BudgetForTarget(triple string) RegisterBudget {
+	switch {
+	case hasPrefix(triple, "x86_64"):
+		return AMD64
+	case hasPrefix(triple, "aarch64"), hasPrefix(triple, "arm64"):
+		return ARM64
+	case hasPrefix(triple, "thumbv6m"), hasPrefix(triple, "thumbv7m"), hasPrefix(triple, "thumbv7em"):
+		return CortexM
+	default:
+		return Default
+	}
+}
+
+func hasPrefix(s, prefix string) bool {
+	return len(s) >= len(prefix) && s[:len(prefix)] == prefix
+}
+
+// LeafKind classifies a single scalar leaf of a flattened aggregate for the
+// purpose of register assignment.
+type LeafKind int
+
+const (
+	// IntLeaf is an integer, pointer, or boolean leaf: it is assigned to the
+	// integer/pointer register pool.
+	IntLeaf LeafKind = iota
+	// FloatLeaf is a floating-point leaf: it is assigned to the
+	// floating-point register pool.
+	FloatLeaf
+)
+
+// Assignment is the result of classifying an aggregate's leaves against a
+// register budget.
+type Assignment struct {
+	// Spilled is true if the leaves did not fit in the available registers.
+	// The aggregate must then be passed as a single value instead of being
+	// expanded into individual arguments.
+	Spilled bool
+}
+
+// Classify greedily assigns each leaf to the next free register in its
+// pool (integer/pointer leaves to the integer pool, floating-point leaves
+// to the float pool, in the order they appear). If either pool runs out of
+// registers before all leaves are assigned, the whole aggregate spills:
+// partial expansion isn't useful, since the caller and callee still need to
+// agree on a single, simple calling convention for the aggregate.
+func Classify(leaves []LeafKind, budget RegisterBudget) Assignment {
+	intUsed, floatUsed := 0, 0
+	for _, leaf := range leaves {
+		switch leaf {
+		case IntLeaf:
+			intUsed++
+		case FloatLeaf:
+			floatUsed++
+		}
+	}
+	if intUsed > budget.IntRegisters || floatUsed > budget.FloatRegisters {
+		return Assignment{Spilled: true}
+	}
+	return Assignment{Spilled: false}
+}
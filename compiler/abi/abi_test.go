@@ -0,0 +1,46 @@
+package abi
+
+import "testing"
+
+func TestBudgetForTarget(t *testing.T) {
+	tests := []struct {
+		triple string
+		want   RegisterBudget
+	}{
+		{"x86_64-unknown-linux-gnu", AMD64},
+		{"aarch64-unknown-linux-gnu", ARM64},
+		{"arm64-apple-macosx", ARM64},
+		{"thumbv7em-none-eabi", CortexM},
+		{"thumbv6m-none-eabi", CortexM},
+		{"riscv32-unknown-none", Default},
+	}
+	for _, tc := range tests {
+		if got := BudgetForTarget(tc.triple); got != tc.want {
+			t.Errorf("BudgetForTarget(%q) = %+v, want %+v", tc.triple, got, tc.want)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	budget := RegisterBudget{IntRegisters: 2, FloatRegisters: 1}
+
+	tests := []struct {
+		name    string
+		leaves  []LeafKind
+		spilled bool
+	}{
+		{"empty", nil, false},
+		{"fits exactly", []LeafKind{IntLeaf, IntLeaf, FloatLeaf}, false},
+		{"int pool exhausted", []LeafKind{IntLeaf, IntLeaf, IntLeaf}, true},
+		{"float pool exhausted", []LeafKind{FloatLeaf, FloatLeaf}, true},
+		{"int pool independent of float pool", []LeafKind{IntLeaf, FloatLeaf}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Classify(tc.leaves, budget)
+			if got.Spilled != tc.spilled {
+				t.Errorf("Classify(%v, %+v).Spilled = %v, want %v", tc.leaves, budget, got.Spilled, tc.spilled)
+			}
+		})
+	}
+}
@@ -4,14 +4,20 @@ import (
 	"fmt"
 	"golang.org/x/tools/go/ssa"
 	"tinygo.org/x/go-llvm"
+
+	"github.com/gwtnz/tinygo/compiler/abi"
 )
 
 // For a description of the calling convention in prose, see:
 // https://tinygo.org/compiler-internals/calling-convention/
-
-// The maximum number of arguments that can be expanded from a single struct. If
-// a struct contains more fields, it is passed as a struct without expanding.
-const MaxFieldsPerParam = 3
+//
+// Structs are expanded into individual call arguments according to a
+// register-based ABI modeled on Go's own amd64/arm64 calling convention:
+// each leaf field is classified as an integer/pointer or floating-point
+// value and greedily assigned to an abstract register in the target's
+// budget (see the abi subpackage). A struct that doesn't fit the budget is
+// passed as a single value instead of being expanded, the same as the
+// MaxFieldsPerParam heuristic this replaced.
 
 // Shortcut: create a call to runtime.<fnName> with the given arguments.
 func (c *Compiler) createRuntimeCall(fnName string, args []llvm.Value, name string) llvm.Value {
@@ -66,14 +72,14 @@ func (b *builder) createCall(fn llvm.Value, args []llvm.Value, name string) llvm
 
 // Expand an argument type to a list that can be used in a function call
 // parameter list.
-func expandFormalParamType(t llvm.Type) []llvm.Type {
+func expandFormalParamType(t llvm.Type, budget abi.RegisterBudget) []llvm.Type {
 	switch t.TypeKind() {
 	case llvm.StructTypeKind:
 		fields := flattenAggregateType(t)
-		if len(fields) <= MaxFieldsPerParam {
+		if !classifyAggregate(fields, budget).Spilled {
 			return fields
 		} else {
-			// failed to lower
+			// doesn't fit in the available registers
 			return []llvm.Type{t}
 		}
 	default:
@@ -82,6 +88,20 @@ func expandFormalParamType(t llvm.Type) []llvm.Type {
 	}
 }
 
+// createFunctionType builds the LLVM type for a function declaration,
+// expanding each formal parameter the same way expandFormalParam expands the
+// matching argument at every call site (createCall/createRuntimeCall), so a
+// declared function's signature can never disagree with how its callers
+// pass arguments to it.
+func (c *Compiler) createFunctionType(paramTypes []llvm.Type, returnType llvm.Type, isVarArg bool) llvm.Type {
+	budget := c.abiBudget()
+	expanded := make([]llvm.Type, 0, len(paramTypes))
+	for _, t := range paramTypes {
+		expanded = append(expanded, expandFormalParamType(t, budget)...)
+	}
+	return llvm.FunctionType(returnType, expanded, isVarArg)
+}
+
 // Expand an argument type to a list of offsets from the start of the object.
 // Used together with expandFormalParam to get the offset of each value from the
 // start of the non-expanded value.
@@ -89,10 +109,10 @@ func (c *Compiler) expandFormalParamOffsets(t llvm.Type) []uint64 {
 	switch t.TypeKind() {
 	case llvm.StructTypeKind:
 		fields := c.flattenAggregateTypeOffsets(t)
-		if len(fields) <= MaxFieldsPerParam {
+		if !classifyAggregate(flattenAggregateType(t), c.abiBudget()).Spilled {
 			return fields
 		} else {
-			// failed to lower
+			// doesn't fit in the available registers
 			return []uint64{0}
 		}
 	default:
@@ -106,14 +126,14 @@ func (c *Compiler) expandFormalParam(v llvm.Value) []llvm.Value {
 	switch v.Type().TypeKind() {
 	case llvm.StructTypeKind:
 		fieldTypes := flattenAggregateType(v.Type())
-		if len(fieldTypes) <= MaxFieldsPerParam {
+		if !classifyAggregate(fieldTypes, c.abiBudget()).Spilled {
 			fields := c.flattenAggregate(v)
 			if len(fields) != len(fieldTypes) {
 				panic("type and value param lowering don't match")
 			}
 			return fields
 		} else {
-			// failed to lower
+			// doesn't fit in the available registers
 			return []llvm.Value{v}
 		}
 	default:
@@ -130,14 +150,14 @@ func (b *builder) expandFormalParam(v llvm.Value) []llvm.Value {
 	switch v.Type().TypeKind() {
 	case llvm.StructTypeKind:
 		fieldTypes := flattenAggregateType(v.Type())
-		if len(fieldTypes) <= MaxFieldsPerParam {
+		if !classifyAggregate(fieldTypes, b.abiBudget()).Spilled {
 			fields := b.flattenAggregate(v)
 			if len(fields) != len(fieldTypes) {
 				panic("type and value param lowering don't match")
 			}
 			return fields
 		} else {
-			// failed to lower
+			// doesn't fit in the available registers
 			return []llvm.Value{v}
 		}
 	default:
@@ -146,6 +166,33 @@ func (b *builder) expandFormalParam(v llvm.Value) []llvm.Value {
 	}
 }
 
+// abiBudget returns the register budget to classify formal parameters
+// against, based on the compilation target.
+func (c *Compiler) abiBudget() abi.RegisterBudget {
+	return abi.BudgetForTarget(c.Triple)
+}
+
+// abiBudget is the builder equivalent of (*Compiler).abiBudget.
+func (b *builder) abiBudget() abi.RegisterBudget {
+	return abi.BudgetForTarget(b.Triple)
+}
+
+// classifyAggregate classifies the flattened leaf types of a struct
+// parameter against the given register budget, greedily assigning integer/
+// pointer leaves and floating-point leaves to their respective register
+// pools. See the abi package for the assignment algorithm.
+func classifyAggregate(fields []llvm.Type, budget abi.RegisterBudget) abi.Assignment {
+	leaves := make([]abi.LeafKind, len(fields))
+	for i, field := range fields {
+		if field.TypeKind() == llvm.FloatTypeKind || field.TypeKind() == llvm.DoubleTypeKind {
+			leaves[i] = abi.FloatLeaf
+		} else {
+			leaves[i] = abi.IntLeaf
+		}
+	}
+	return abi.Classify(leaves, budget)
+}
+
 // Try to flatten a struct type to a list of types. Returns a 1-element slice
 // with the passed in type if this is not possible.
 func flattenAggregateType(t llvm.Type) []llvm.Type {
@@ -230,7 +277,7 @@ func (c *Compiler) collapseFormalParam(t llvm.Type, fields []llvm.Value) llvm.Va
 func (c *Compiler) collapseFormalParamInternal(t llvm.Type, fields []llvm.Value) (llvm.Value, []llvm.Value) {
 	switch t.TypeKind() {
 	case llvm.StructTypeKind:
-		if len(flattenAggregateType(t)) <= MaxFieldsPerParam {
+		if !classifyAggregate(flattenAggregateType(t), c.abiBudget()).Spilled {
 			value := llvm.ConstNull(t)
 			for i, subtyp := range t.StructElementTypes() {
 				structField, remaining := c.collapseFormalParamInternal(subtyp, fields)
@@ -0,0 +1,54 @@
+package compiler
+
+// This file holds the shared compiler and per-function builder state that
+// the rest of this package operates on.
+
+import (
+	"tinygo.org/x/go-llvm"
+
+	"github.com/gwtnz/tinygo/ir"
+)
+
+// Compiler holds state that is shared across the whole compilation: the
+// LLVM module being built, the lowered program, and target-specific
+// properties derived from it.
+type Compiler struct {
+	ir          *ir.Program
+	mod         llvm.Module
+	ctx         llvm.Context
+	builder     llvm.Builder
+	targetData  llvm.TargetData
+	i8ptrType   llvm.Type
+	uintptrType llvm.Type
+
+	// Triple is the LLVM target triple being compiled for, e.g.
+	// "thumbv7em-none-eabi". It drives target-specific decisions like the
+	// ABI register budget (see abiBudget).
+	Triple string
+}
+
+// builder wraps Compiler with the per-function state needed while lowering
+// a single function to LLVM IR, including its own llvm.Builder positioned
+// inside that function.
+type builder struct {
+	*Compiler
+	llvm.Builder
+
+	// mapKeyFuncCache holds the generated equality/hash function pairs for
+	// map key types that need them (see mapkeys.go), keyed by
+	// types.Type.String(). It lives as long as the builder, so looking up
+	// the same key type twice within one function doesn't search the module
+	// again; thunks generated by earlier builders are found in the module by
+	// getMapKeyFuncs.
+	mapKeyFuncCache map[string]mapKeyFuncs
+}
+
+// newBuilder creates a builder for lowering a single function, with its
+// caches ready to use.
+func newBuilder(c *Compiler, irbuilder llvm.Builder) *builder {
+	return &builder{
+		Compiler:        c,
+		Builder:         irbuilder,
+		mapKeyFuncCache: make(map[string]mapKeyFuncs),
+	}
+}
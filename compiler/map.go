@@ -9,6 +9,27 @@ import (
 	"tinygo.org/x/go-llvm"
 )
 
+// createMakeMap implements the make(map[K]V) builtin: it calls runtime.
+// hashmapMake with the key/value size and alignment of this particular
+// map's key/value types, which is what makes the bucket layout in
+// runtime/hashmap.go able to place 8-byte-aligned keys/values (float64,
+// complex128, ...) correctly on 32-bit targets.
+func (b *builder) createMakeMap(keyType, valueType types.Type) llvm.Value {
+	llvmKeyType := b.getLLVMType(keyType)
+	llvmValueType := b.getLLVMType(valueType)
+	keySize := b.targetData.TypeAllocSize(llvmKeyType)
+	valueSize := b.targetData.TypeAllocSize(llvmValueType)
+	keyAlign := b.targetData.ABIAlignmentOfType(llvmKeyType)
+	valueAlign := b.targetData.ABIAlignmentOfType(llvmValueType)
+	params := []llvm.Value{
+		llvm.ConstInt(b.ctx.Int8Type(), keySize, false),
+		llvm.ConstInt(b.ctx.Int8Type(), valueSize, false),
+		llvm.ConstInt(b.ctx.Int8Type(), uint64(keyAlign), false),
+		llvm.ConstInt(b.ctx.Int8Type(), uint64(valueAlign), false),
+	}
+	return b.createRuntimeCall("hashmapMake", params, "")
+}
+
 // createMapLookup returns the value in a map. It calls a runtime function
 // depending on the map key type to load the map value and its comma-ok value.
 func (b *builder) createMapLookup(keyType, valueType types.Type, m, key llvm.Value, commaOk bool, pos token.Pos) (llvm.Value, error) {
@@ -21,11 +42,12 @@ func (b *builder) createMapLookup(keyType, valueType types.Type, m, key llvm.Val
 
 	// Do the lookup. How it is done depends on the key type.
 	var commaOkValue llvm.Value
-	if t, ok := keyType.(*types.Basic); ok && t.Info()&types.IsString != 0 {
+	switch classifyMapKey(keyType) {
+	case mapKeyString:
 		// key is a string
 		params := []llvm.Value{m, key, mapValuePtr}
 		commaOkValue = b.createRuntimeCall("hashmapStringGet", params, "")
-	} else if hashmapIsBinaryKey(keyType) {
+	case mapKeyBinary:
 		// key can be compared with runtime.memequal
 		// Store the key in an alloca, in the entry block to avoid dynamic stack
 		// growth.
@@ -35,9 +57,15 @@ func (b *builder) createMapLookup(keyType, valueType types.Type, m, key llvm.Val
 		params := []llvm.Value{m, mapKeyPtr, mapValuePtr}
 		commaOkValue = b.createRuntimeCall("hashmapBinaryGet", params, "")
 		b.emitLifetimeEnd(mapKeyPtr, mapKeySize)
-	} else {
-		// Not trivially comparable using memcmp.
-		return llvm.Value{}, b.makeError(pos, "only strings, bools, ints, pointers or structs of bools/ints are supported as map keys, but got: "+keyType.String())
+	default:
+		// Key needs a generated equality/hash function pair (floats, complex
+		// numbers, interfaces, or aggregates containing any of those).
+		funcs := b.getMapKeyFuncs(keyType)
+		mapKeyAlloca, mapKeyPtr, mapKeySize := b.createTemporaryAlloca(key.Type(), "hashmap.key")
+		b.CreateStore(key, mapKeyAlloca)
+		params := []llvm.Value{m, mapKeyPtr, mapValuePtr, funcs.equals, funcs.hash}
+		commaOkValue = b.createRuntimeCall("hashmapGet", params, "")
+		b.emitLifetimeEnd(mapKeyPtr, mapKeySize)
 	}
 
 	// Load the resulting value from the hashmap. The value is set to the zero
@@ -61,19 +89,25 @@ func (b *builder) createMapUpdate(keyType types.Type, m, key, value llvm.Value,
 	valueAlloca, valuePtr, valueSize := b.createTemporaryAlloca(value.Type(), "hashmap.value")
 	b.CreateStore(value, valueAlloca)
 	keyType = keyType.Underlying()
-	if t, ok := keyType.(*types.Basic); ok && t.Info()&types.IsString != 0 {
+	switch classifyMapKey(keyType) {
+	case mapKeyString:
 		// key is a string
 		params := []llvm.Value{m, key, valuePtr}
 		b.createRuntimeCall("hashmapStringSet", params, "")
-	} else if hashmapIsBinaryKey(keyType) {
+	case mapKeyBinary:
 		// key can be compared with runtime.memequal
 		keyAlloca, keyPtr, keySize := b.createTemporaryAlloca(key.Type(), "hashmap.key")
 		b.CreateStore(key, keyAlloca)
 		params := []llvm.Value{m, keyPtr, valuePtr}
 		b.createRuntimeCall("hashmapBinarySet", params, "")
 		b.emitLifetimeEnd(keyPtr, keySize)
-	} else {
-		b.addError(pos, "only strings, bools, ints, pointers or structs of bools/ints are supported as map keys, but got: "+keyType.String())
+	default:
+		funcs := b.getMapKeyFuncs(keyType)
+		keyAlloca, keyPtr, keySize := b.createTemporaryAlloca(key.Type(), "hashmap.key")
+		b.CreateStore(key, keyAlloca)
+		params := []llvm.Value{m, keyPtr, valuePtr, funcs.equals, funcs.hash}
+		b.createRuntimeCall("hashmapSet", params, "")
+		b.emitLifetimeEnd(keyPtr, keySize)
 	}
 	b.emitLifetimeEnd(valuePtr, valueSize)
 }
@@ -82,47 +116,58 @@ func (b *builder) createMapUpdate(keyType types.Type, m, key, value llvm.Value,
 // function. It is the implementation of the Go delete() builtin.
 func (b *builder) createMapDelete(keyType types.Type, m, key llvm.Value, pos token.Pos) error {
 	keyType = keyType.Underlying()
-	if t, ok := keyType.(*types.Basic); ok && t.Info()&types.IsString != 0 {
+	switch classifyMapKey(keyType) {
+	case mapKeyString:
 		// key is a string
 		params := []llvm.Value{m, key}
 		b.createRuntimeCall("hashmapStringDelete", params, "")
 		return nil
-	} else if hashmapIsBinaryKey(keyType) {
+	case mapKeyBinary:
 		keyAlloca, keyPtr, keySize := b.createTemporaryAlloca(key.Type(), "hashmap.key")
 		b.CreateStore(key, keyAlloca)
 		params := []llvm.Value{m, keyPtr}
 		b.createRuntimeCall("hashmapBinaryDelete", params, "")
 		b.emitLifetimeEnd(keyPtr, keySize)
 		return nil
-	} else {
-		return b.makeError(pos, "only strings, bools, ints, pointers or structs of bools/ints are supported as map keys, but got: "+keyType.String())
+	default:
+		funcs := b.getMapKeyFuncs(keyType)
+		keyAlloca, keyPtr, keySize := b.createTemporaryAlloca(key.Type(), "hashmap.key")
+		b.CreateStore(key, keyAlloca)
+		params := []llvm.Value{m, keyPtr, funcs.equals, funcs.hash}
+		b.createRuntimeCall("hashmapDelete", params, "")
+		b.emitLifetimeEnd(keyPtr, keySize)
+		return nil
 	}
 }
 
-// Get FNV-1a hash of this string.
-//
-// https://en.wikipedia.org/wiki/Fowler%E2%80%93Noll%E2%80%93Vo_hash_function#FNV-1a_hash
-func hashmapHash(data []byte) uint32 {
-	var result uint32 = 2166136261 // FNV offset basis
-	for _, c := range data {
-		result ^= uint32(c)
-		result *= 16777619 // FNV prime
-	}
-	return result
-}
+// mapKeyClass describes how a given map key type must be handled: with the
+// fast binary (memequal) path, the dedicated string path, or by dispatching
+// through generated per-type equality/hash functions. See mapkeys.go.
+type mapKeyClass int
+
+const (
+	mapKeyBinary mapKeyClass = iota
+	mapKeyString
+	mapKeyFuncs
+)
 
-// Get the topmost 8 bits of the hash, without using a special value (like 0).
-func hashmapTopHash(hash uint32) uint8 {
-	tophash := uint8(hash >> 24)
-	if tophash < 1 {
-		// 0 means empty slot, so make it bigger.
-		tophash += 1
+// classifyMapKey determines how the given map key type should be compared
+// and hashed.
+func classifyMapKey(keyType types.Type) mapKeyClass {
+	keyType = keyType.Underlying()
+	if t, ok := keyType.(*types.Basic); ok && t.Info()&types.IsString != 0 {
+		return mapKeyString
+	}
+	if hashmapIsBinaryKey(keyType) {
+		return mapKeyBinary
 	}
-	return tophash
+	return mapKeyFuncs
 }
 
-// Returns true if this key type does not contain strings, interfaces etc., so
-// can be compared with runtime.memequal.
+// Returns true if this key type is made up only of bools, integers and
+// pointers (directly, or as fields of structs or elements of arrays), so it
+// can be compared with runtime.memequal and hashed over its raw bytes. Every
+// other type, including channels and unsafe.Pointer, returns false.
 func hashmapIsBinaryKey(keyType types.Type) bool {
 	switch keyType := keyType.(type) {
 	case *types.Basic:
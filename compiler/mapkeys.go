@@ -0,0 +1,252 @@
+package compiler
+
+// This file generates the equality and hash functions used for map key types
+// that don't fit the fast binary or string paths in map.go (floats, complex
+// numbers, interfaces, and aggregates containing any of those). The actual
+// hashing of raw bytes (for string leaves) happens in the runtime, where the
+// runtime.hashmapAlgorithmName variable selects the algorithm; see
+// runtime/hashmap.go.
+
+import (
+	"go/types"
+
+	"tinygo.org/x/go-llvm"
+)
+
+// mapKeyFuncs holds the pair of generated functions needed to use a given
+// type as a map key through the generic hashmapGet/Set/Delete runtime calls:
+//
+//	equals: func(a, b unsafe.Pointer) bool
+//	hash:   func(ptr unsafe.Pointer, size uintptr) uint32
+type mapKeyFuncs struct {
+	equals llvm.Value
+	hash   llvm.Value
+}
+
+// getMapKeyFuncs returns the equality and hash functions to use for the
+// given map key type, generating and caching them the first time this
+// particular key type is requested during this compilation.
+func (b *builder) getMapKeyFuncs(keyType types.Type) mapKeyFuncs {
+	name := keyType.String()
+	if funcs, ok := b.mapKeyFuncCache[name]; ok {
+		return funcs
+	}
+	if equals := b.mod.NamedFunction("runtime.hashmap.equal$" + name); !equals.IsNil() {
+		// Already generated by another builder in this compilation.
+		funcs := mapKeyFuncs{equals: equals, hash: b.mod.NamedFunction("runtime.hashmap.hash$" + name)}
+		b.mapKeyFuncCache[name] = funcs
+		return funcs
+	}
+	funcs := mapKeyFuncs{
+		equals: b.createMapKeyEqualsFunc(keyType, name),
+		hash:   b.createMapKeyHashFunc(keyType, name),
+	}
+	b.mapKeyFuncCache[name] = funcs
+	return funcs
+}
+
+// createMapKeyEqualsFunc synthesizes a `func(a, b unsafe.Pointer) bool`
+// that compares two values of keyType, loaded from the given pointers,
+// field by field.
+func (b *builder) createMapKeyEqualsFunc(keyType types.Type, name string) llvm.Value {
+	llvmType := b.getLLVMType(keyType)
+	fnType := b.createFunctionType([]llvm.Type{b.i8ptrType, b.i8ptrType}, b.ctx.Int1Type(), false)
+	fn := llvm.AddFunction(b.mod, "runtime.hashmap.equal$"+name, fnType)
+	fn.SetLinkage(llvm.InternalLinkage)
+
+	irbuilder := b.ctx.NewBuilder()
+	defer irbuilder.Dispose()
+	entry := b.ctx.AddBasicBlock(fn, "entry")
+	irbuilder.SetInsertPointAtEnd(entry)
+
+	aPtr := irbuilder.CreateBitCast(fn.Param(0), llvm.PointerType(llvmType, 0), "a")
+	bPtr := irbuilder.CreateBitCast(fn.Param(1), llvm.PointerType(llvmType, 0), "b")
+	a := irbuilder.CreateLoad(aPtr, "a.val")
+	b2 := irbuilder.CreateLoad(bPtr, "b.val")
+
+	result := emitFieldEquals(irbuilder, b, keyType, a, b2)
+	irbuilder.CreateRet(result)
+	return fn
+}
+
+// emitRuntimeCall inserts a call to runtime.<fnName> at irbuilder's current
+// position. It is the equivalent of (*builder).createRuntimeCall for use
+// inside the freestanding IR functions generated in this file, which build
+// with their own llvm.Builder rather than the enclosing builder's.
+func emitRuntimeCall(irbuilder llvm.Builder, b *builder, fnName string, args []llvm.Value) llvm.Value {
+	fn := b.mod.NamedFunction("runtime." + fnName)
+	if fn.IsNil() {
+		panic("trying to call non-existing function: runtime." + fnName)
+	}
+	args = append(args, llvm.Undef(b.i8ptrType))            // unused context parameter
+	args = append(args, llvm.ConstPointerNull(b.i8ptrType)) // coroutine handle
+	// Expand the arguments the same way createCall does, but emit the
+	// expansion and the call through irbuilder.
+	return (&builder{Compiler: b.Compiler, Builder: irbuilder}).createCall(fn, args, "")
+}
+
+// createMapKeyHashFunc synthesizes a `func(ptr unsafe.Pointer, size
+// uintptr) uint32` that hashes a value of keyType, loaded from the given
+// pointer.
+func (b *builder) createMapKeyHashFunc(keyType types.Type, name string) llvm.Value {
+	llvmType := b.getLLVMType(keyType)
+	fnType := b.createFunctionType([]llvm.Type{b.i8ptrType, b.uintptrType}, b.ctx.Int32Type(), false)
+	fn := llvm.AddFunction(b.mod, "runtime.hashmap.hash$"+name, fnType)
+	fn.SetLinkage(llvm.InternalLinkage)
+
+	irbuilder := b.ctx.NewBuilder()
+	defer irbuilder.Dispose()
+	entry := b.ctx.AddBasicBlock(fn, "entry")
+	irbuilder.SetInsertPointAtEnd(entry)
+
+	ptr := irbuilder.CreateBitCast(fn.Param(0), llvm.PointerType(llvmType, 0), "ptr")
+	value := irbuilder.CreateLoad(ptr, "val")
+
+	hash := emitFieldHash(irbuilder, b, keyType, value)
+	irbuilder.CreateRet(hash)
+	return fn
+}
+
+// emitFieldEquals recursively builds the IR that compares two LLVM values of
+// the same (possibly aggregate) Go type, combining the result of each leaf
+// comparison with a boolean AND.
+//
+// Floats are compared with an ordered floating point comparison so that NaN
+// keys never compare equal, matching the Go language spec even though NaN
+// bit patterns are canonicalized for hashing purposes in emitFieldHash.
+func emitFieldEquals(irbuilder llvm.Builder, b *builder, t types.Type, a, v llvm.Value) llvm.Value {
+	switch t := t.Underlying().(type) {
+	case *types.Basic:
+		switch {
+		case t.Info()&types.IsFloat != 0:
+			return irbuilder.CreateFCmp(llvm.FloatOEQ, a, v, "")
+		case t.Info()&types.IsComplex != 0:
+			re := irbuilder.CreateFCmp(llvm.FloatOEQ, irbuilder.CreateExtractValue(a, 0, ""), irbuilder.CreateExtractValue(v, 0, ""), "")
+			im := irbuilder.CreateFCmp(llvm.FloatOEQ, irbuilder.CreateExtractValue(a, 1, ""), irbuilder.CreateExtractValue(v, 1, ""), "")
+			return irbuilder.CreateAnd(re, im, "")
+		case t.Info()&types.IsString != 0:
+			return emitRuntimeCall(irbuilder, b, "stringEqual", []llvm.Value{a, v})
+		default:
+			return irbuilder.CreateICmp(llvm.IntEQ, a, v, "")
+		}
+	case *types.Interface:
+		return emitRuntimeCall(irbuilder, b, "interfaceEqual", []llvm.Value{a, v})
+	case *types.Struct:
+		result := llvm.ConstInt(b.ctx.Int1Type(), 1, false)
+		for i := 0; i < t.NumFields(); i++ {
+			fieldType := t.Field(i).Type()
+			fieldA := irbuilder.CreateExtractValue(a, i, "")
+			fieldB := irbuilder.CreateExtractValue(v, i, "")
+			result = irbuilder.CreateAnd(result, emitFieldEquals(irbuilder, b, fieldType, fieldA, fieldB), "")
+		}
+		return result
+	case *types.Array:
+		result := llvm.ConstInt(b.ctx.Int1Type(), 1, false)
+		for i := 0; i < t.Len(); i++ {
+			elemA := irbuilder.CreateExtractValue(a, i, "")
+			elemB := irbuilder.CreateExtractValue(v, i, "")
+			result = irbuilder.CreateAnd(result, emitFieldEquals(irbuilder, b, t.Elem(), elemA, elemB), "")
+		}
+		return result
+	default:
+		// Pointers and channels are plain values that can be compared
+		// directly once loaded.
+		return irbuilder.CreateICmp(llvm.IntEQ, a, v, "")
+	}
+}
+
+// emitFieldHash recursively builds the IR that hashes an LLVM value of the
+// given (possibly aggregate) Go type, mixing child hashes together.
+func emitFieldHash(irbuilder llvm.Builder, b *builder, t types.Type, v llvm.Value) llvm.Value {
+	i32 := b.ctx.Int32Type()
+	switch t := t.Underlying().(type) {
+	case *types.Basic:
+		switch {
+		case t.Info()&types.IsFloat != 0:
+			bits := canonicalizeFloatBits(irbuilder, v)
+			if bits.Type() == i32 {
+				// float32: already the right width.
+				return bits
+			}
+			// float64: fold the high and low 32 bits together rather than
+			// simply truncating, so both halves of the value affect the hash.
+			hi := irbuilder.CreateTrunc(irbuilder.CreateLShr(bits, llvm.ConstInt(bits.Type(), 32, false), ""), i32, "")
+			lo := irbuilder.CreateTrunc(bits, i32, "")
+			return irbuilder.CreateXor(hi, lo, "")
+		case t.Info()&types.IsComplex != 0:
+			re := emitFieldHash(irbuilder, b, types.Typ[types.Float64], irbuilder.CreateExtractValue(v, 0, ""))
+			im := emitFieldHash(irbuilder, b, types.Typ[types.Float64], irbuilder.CreateExtractValue(v, 1, ""))
+			return irbuilder.CreateXor(re, im, "")
+		case t.Info()&types.IsString != 0:
+			return emitRuntimeCall(irbuilder, b, "hashmapHashString", []llvm.Value{v})
+		case t.Kind() == types.UnsafePointer:
+			return irbuilder.CreateTrunc(irbuilder.CreatePtrToInt(v, b.uintptrType, ""), i32, "")
+		default:
+			// CreateZExt/CreateTrunc both require the destination to be
+			// strictly wider/narrower than the source, so pick the right one
+			// (or neither, at exactly 32 bits) based on the leaf's actual
+			// width instead of always zero-extending to 64 first: ordinary
+			// 64-bit leaves (int64, uintptr on amd64/arm64, ...) would
+			// otherwise hit an invalid same-width CreateZExt.
+			switch width := v.Type().IntTypeWidth(); {
+			case width < 32:
+				return irbuilder.CreateZExt(v, i32, "")
+			case width > 32:
+				return irbuilder.CreateTrunc(v, i32, "")
+			default:
+				return v
+			}
+		}
+	case *types.Interface:
+		return emitRuntimeCall(irbuilder, b, "hashmapHashInterface", []llvm.Value{v})
+	case *types.Struct:
+		hash := llvm.ConstInt(i32, 0, false)
+		for i := 0; i < t.NumFields(); i++ {
+			fieldHash := emitFieldHash(irbuilder, b, t.Field(i).Type(), irbuilder.CreateExtractValue(v, i, ""))
+			// Rotate left by 1 bit before mixing in the next field, so that
+			// field order affects the result (avoids trivial collisions
+			// between structs with the same field values in a different
+			// order).
+			rotated := irbuilder.CreateOr(
+				irbuilder.CreateShl(hash, llvm.ConstInt(i32, 1, false), ""),
+				irbuilder.CreateLShr(hash, llvm.ConstInt(i32, 31, false), ""), "")
+			hash = irbuilder.CreateXor(rotated, fieldHash, "")
+		}
+		return hash
+	case *types.Array:
+		hash := llvm.ConstInt(i32, 0, false)
+		for i := 0; i < t.Len(); i++ {
+			elemHash := emitFieldHash(irbuilder, b, t.Elem(), irbuilder.CreateExtractValue(v, i, ""))
+			hash = irbuilder.CreateXor(hash, elemHash, "")
+		}
+		return hash
+	default:
+		return irbuilder.CreateTrunc(irbuilder.CreatePtrToInt(v, b.uintptrType, ""), i32, "")
+	}
+}
+
+// canonicalizeFloatBits returns the bit pattern of a float, with all NaNs
+// folded to a single pattern and -0 folded to +0, so that values which
+// compare unequal (NaN) or equal (+0/-0) under emitFieldEquals still hash
+// consistently. float32 and float64 are handled separately since they need
+// differently-sized integer types and NaN bit patterns.
+func canonicalizeFloatBits(irbuilder llvm.Builder, v llvm.Value) llvm.Value {
+	var intType llvm.Type
+	var canonicalNaN uint64
+	switch v.Type().TypeKind() {
+	case llvm.FloatTypeKind:
+		intType = llvm.Int32Type()
+		canonicalNaN = 0x7fc00000
+	case llvm.DoubleTypeKind:
+		intType = llvm.Int64Type()
+		canonicalNaN = 0x7ff8000000000000
+	default:
+		panic("canonicalizeFloatBits: not a float or double")
+	}
+	bits := irbuilder.CreateBitCast(v, intType, "")
+	isZero := irbuilder.CreateFCmp(llvm.FloatOEQ, v, llvm.ConstNull(v.Type()), "")
+	isNaN := irbuilder.CreateFCmp(llvm.FloatUNO, v, v, "")
+	bits = irbuilder.CreateSelect(isZero, llvm.ConstInt(intType, 0, false), bits, "")
+	bits = irbuilder.CreateSelect(isNaN, llvm.ConstInt(intType, canonicalNaN, false), bits, "")
+	return bits
+}
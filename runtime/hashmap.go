@@ -0,0 +1,338 @@
+package runtime
+
+// This file implements the Go map runtime. It backs the map operations
+// lowered by the compiler (see compiler/map.go and compiler/mapkeys.go):
+// binary keys (bools, ints, pointers, and structs/arrays of those) and
+// string keys get a built-in equality/hash pair constructed from the key
+// size known at the call site; every other key type (floats, complex
+// numbers, interfaces, and aggregates containing any of those) is handed a
+// pair of compiler-generated thunks. All three go through the same
+// bucket/tophash engine below.
+
+import "unsafe"
+
+// hashmapBucketCount is the number of (tophash, key, value) slots in a
+// single bucket, same as upstream Go.
+const hashmapBucketCount = 8
+
+// hashmapAlgorithmName selects the 32-bit hash function hashmapHash uses to
+// hash raw key bytes. It defaults to "fnv1a"; "xxh32" and "memhash" select
+// the other two hash functions below, and any other value falls back to
+// fnv1a. There is no `-hash` compiler flag that sets it.
+var hashmapAlgorithmName = "fnv1a"
+
+// hashmapHash hashes a run of bytes with the configured algorithm. This
+// used to be a string-only FNV-1a helper living in the compiler
+// (hashmapHash in compiler/map.go); it now lives here so that binary keys,
+// string keys, and the string and interface leaves hashed by
+// compiler-generated thunks all hash their bytes through the same,
+// configurable place. The thunks hash other leaves (ints, floats, pointers)
+// directly in generated IR.
+func hashmapHash(data []byte) uint32 {
+	switch hashmapAlgorithmName {
+	case "xxh32":
+		return hashmapHashXXH32(data)
+	case "memhash":
+		return hashmapHashMemhash(data)
+	default:
+		return hashmapHashFNV1A(data)
+	}
+}
+
+// hashmapHashFNV1A is the original FNV-1a hash.
+//
+// https://en.wikipedia.org/wiki/Fowler%E2%80%93Noll%E2%80%93Vo_hash_function#FNV-1a_hash
+func hashmapHashFNV1A(data []byte) uint32 {
+	var result uint32 = 2166136261 // FNV offset basis
+	for _, c := range data {
+		result ^= uint32(c)
+		result *= 16777619 // FNV prime
+	}
+	return result
+}
+
+// hashmapHashXXH32 is a small, branch-light 32-bit hash: a good default for
+// targets that can spare a little extra flash in exchange for noticeably
+// fewer collisions than FNV-1a.
+func hashmapHashXXH32(data []byte) uint32 {
+	const prime1, prime2, prime3, prime5 = 2654435761, 2246822519, 3266489917, 374761393
+	hash := prime5 + uint32(len(data))
+	for _, c := range data {
+		hash += uint32(c) * prime5
+		hash = (hash<<11 | hash>>21) * prime1
+	}
+	hash ^= hash >> 15
+	hash *= prime2
+	hash ^= hash >> 13
+	hash *= prime3
+	hash ^= hash >> 16
+	return hash
+}
+
+// hashmapHashMemhash mixes the key word-by-word instead of byte-by-byte,
+// trading a slightly worse distribution for fewer loop iterations on
+// larger keys.
+func hashmapHashMemhash(data []byte) uint32 {
+	hash := uint32(2166136261)
+	i := 0
+	for ; i+4 <= len(data); i += 4 {
+		word := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		hash = (hash ^ word) * 16777619
+	}
+	for ; i < len(data); i++ {
+		hash = (hash ^ uint32(data[i])) * 16777619
+	}
+	return hash
+}
+
+// hashmapTopHash returns the topmost 8 bits of the hash, stored in the
+// bucket so a lookup can rule out non-matching slots without doing a full
+// key comparison. 0 is reserved to mark an empty slot, so it is never
+// returned here.
+func hashmapTopHash(hash uint32) uint8 {
+	tophash := uint8(hash >> 24)
+	if tophash < 1 {
+		// 0 means empty slot, so make it bigger.
+		tophash += 1
+	}
+	return tophash
+}
+
+// hashmap is the implementation of the Go map type.
+type hashmap struct {
+	buckets    *hashmapBucket
+	count      uintptr
+	keySize    uint8
+	valueSize  uint8
+	keyAlign   uint8
+	valueAlign uint8
+}
+
+// hashmapMake creates a new, empty map for a key/value pair of the given
+// sizes and alignments. It is the runtime call behind the make(map[K]V)
+// builtin (see (*builder).createMakeMap in compiler/map.go), which is also
+// the only place keyAlign/valueAlign are ever populated: every hashmap that
+// exists was built through here, so key()/value()/addBucket() can rely on
+// them being the real alignment of K and V rather than 0.
+func hashmapMake(keySize, valueSize, keyAlign, valueAlign uint8) *hashmap {
+	return &hashmap{
+		keySize:    keySize,
+		valueSize:  valueSize,
+		keyAlign:   keyAlign,
+		valueAlign: valueAlign,
+	}
+}
+
+// hashmapBucket is the layout every bucket starts with. The keys and
+// values themselves are stored as flexible array members right after this
+// header, keySize/valueSize bytes at a time: first hashmapBucketCount keys,
+// then hashmapBucketCount values. Both arrays start on a boundary aligned to
+// their element type (see alignUp), matching the real Go runtime's bucket
+// layout: without this, 8-byte-aligned keys/values (float64, complex128,
+// and aggregates containing them) would land on a misaligned address on
+// 32-bit targets, where sizeof(hashmapBucket) is only 4-byte aligned.
+type hashmapBucket struct {
+	tophash [hashmapBucketCount]uint8
+	next    *hashmapBucket
+}
+
+// alignUp rounds offset up to the nearest multiple of align (treating an
+// align of 0, as produced for zero-sized types, as 1).
+func alignUp(offset uintptr, align uint8) uintptr {
+	a := uintptr(align)
+	if a == 0 {
+		a = 1
+	}
+	return (offset + a - 1) &^ (a - 1)
+}
+
+func (b *hashmapBucket) key(slot int, keySize, keyAlign uint8) unsafe.Pointer {
+	base := alignUp(unsafe.Sizeof(*b), keyAlign)
+	offset := base + uintptr(slot)*uintptr(keySize)
+	return unsafe.Add(unsafe.Pointer(b), offset)
+}
+
+func (b *hashmapBucket) value(slot int, keySize, keyAlign, valueSize, valueAlign uint8) unsafe.Pointer {
+	keysBase := alignUp(unsafe.Sizeof(*b), keyAlign)
+	keysEnd := keysBase + uintptr(hashmapBucketCount)*uintptr(keySize)
+	valuesBase := alignUp(keysEnd, valueAlign)
+	offset := valuesBase + uintptr(slot)*uintptr(valueSize)
+	return unsafe.Add(unsafe.Pointer(b), offset)
+}
+
+// hashmapEqualFunc and hashmapHashFunc are the signatures of the per-key-
+// type thunks the compiler generates for key types that don't fit the
+// binary or string fast paths (see compiler/mapkeys.go). The binary and
+// string families below construct equivalent closures over the key size
+// known at the call site, so every key family runs through the same
+// engine.
+type hashmapEqualFunc func(a, b unsafe.Pointer) bool
+type hashmapHashFunc func(ptr unsafe.Pointer, size uintptr) uint32
+
+// hashmapGet looks up keyPtr using the given equality/hash functions, and
+// copies the value (or the zero value, if the key isn't present) into
+// valuePtr. It returns whether the key was found.
+func hashmapGet(m *hashmap, keyPtr, valuePtr unsafe.Pointer, eq hashmapEqualFunc, hash hashmapHashFunc) bool {
+	if m == nil || m.count == 0 {
+		memzero(valuePtr, uintptr(m.valueSizeOrZero()))
+		return false
+	}
+	top := hashmapTopHash(hash(keyPtr, uintptr(m.keySize)))
+	for b := m.buckets; b != nil; b = b.next {
+		for slot := 0; slot < hashmapBucketCount; slot++ {
+			if b.tophash[slot] != top {
+				continue
+			}
+			if eq(keyPtr, b.key(slot, m.keySize, m.keyAlign)) {
+				memcpy(valuePtr, b.value(slot, m.keySize, m.keyAlign, m.valueSize, m.valueAlign), uintptr(m.valueSize))
+				return true
+			}
+		}
+	}
+	memzero(valuePtr, uintptr(m.valueSize))
+	return false
+}
+
+// hashmapSet inserts or updates keyPtr with the value at valuePtr.
+func hashmapSet(m *hashmap, keyPtr, valuePtr unsafe.Pointer, eq hashmapEqualFunc, hash hashmapHashFunc) {
+	top := hashmapTopHash(hash(keyPtr, uintptr(m.keySize)))
+	var emptyBucket *hashmapBucket
+	emptySlot := -1
+	var last *hashmapBucket
+	for b := m.buckets; b != nil; b = b.next {
+		for slot := 0; slot < hashmapBucketCount; slot++ {
+			switch {
+			case b.tophash[slot] == top && eq(keyPtr, b.key(slot, m.keySize, m.keyAlign)):
+				memcpy(b.value(slot, m.keySize, m.keyAlign, m.valueSize, m.valueAlign), valuePtr, uintptr(m.valueSize))
+				return
+			case b.tophash[slot] == 0 && emptyBucket == nil:
+				emptyBucket, emptySlot = b, slot
+			}
+		}
+		last = b
+	}
+	if emptyBucket == nil {
+		emptyBucket = m.addBucket(last)
+		emptySlot = 0
+	}
+	emptyBucket.tophash[emptySlot] = top
+	memcpy(emptyBucket.key(emptySlot, m.keySize, m.keyAlign), keyPtr, uintptr(m.keySize))
+	memcpy(emptyBucket.value(emptySlot, m.keySize, m.keyAlign, m.valueSize, m.valueAlign), valuePtr, uintptr(m.valueSize))
+	m.count++
+}
+
+// hashmapDelete removes keyPtr from the map, if present.
+func hashmapDelete(m *hashmap, keyPtr unsafe.Pointer, eq hashmapEqualFunc, hash hashmapHashFunc) {
+	if m == nil || m.count == 0 {
+		return
+	}
+	top := hashmapTopHash(hash(keyPtr, uintptr(m.keySize)))
+	for b := m.buckets; b != nil; b = b.next {
+		for slot := 0; slot < hashmapBucketCount; slot++ {
+			if b.tophash[slot] == top && eq(keyPtr, b.key(slot, m.keySize, m.keyAlign)) {
+				b.tophash[slot] = 0
+				m.count--
+				return
+			}
+		}
+	}
+}
+
+// addBucket appends a fresh overflow bucket after last (or becomes the
+// first bucket, if the map was empty) and returns it.
+func (m *hashmap) addBucket(last *hashmapBucket) *hashmapBucket {
+	keysBase := alignUp(unsafe.Sizeof(hashmapBucket{}), m.keyAlign)
+	keysEnd := keysBase + uintptr(hashmapBucketCount)*uintptr(m.keySize)
+	valuesBase := alignUp(keysEnd, m.valueAlign)
+	size := valuesBase + uintptr(hashmapBucketCount)*uintptr(m.valueSize)
+	b := (*hashmapBucket)(alloc(size))
+	if last == nil {
+		m.buckets = b
+	} else {
+		last.next = b
+	}
+	return b
+}
+
+// valueSizeOrZero returns the value size, or 0 for a nil map (used so
+// hashmapGet can still zero the caller's output buffer to the right size
+// even when called on a nil map).
+func (m *hashmap) valueSizeOrZero() uint8 {
+	if m == nil {
+		return 0
+	}
+	return m.valueSize
+}
+
+// hashmapBinaryGet, hashmapBinarySet and hashmapBinaryDelete are the map
+// operations for keys that are plain sequences of bytes (bools, ints,
+// pointers, and structs/arrays of those): equality is a memequal and the
+// hash is computed directly over the key bytes.
+func hashmapBinaryGet(m *hashmap, keyPtr, valuePtr unsafe.Pointer) bool {
+	keySize := uintptr(m.keySize)
+	return hashmapGet(m, keyPtr, valuePtr, hashmapBinaryEqual(keySize), hashmapBinaryHash)
+}
+
+func hashmapBinarySet(m *hashmap, keyPtr, valuePtr unsafe.Pointer) {
+	keySize := uintptr(m.keySize)
+	hashmapSet(m, keyPtr, valuePtr, hashmapBinaryEqual(keySize), hashmapBinaryHash)
+}
+
+func hashmapBinaryDelete(m *hashmap, keyPtr unsafe.Pointer) {
+	keySize := uintptr(m.keySize)
+	hashmapDelete(m, keyPtr, hashmapBinaryEqual(keySize), hashmapBinaryHash)
+}
+
+func hashmapBinaryEqual(keySize uintptr) hashmapEqualFunc {
+	return func(a, b unsafe.Pointer) bool {
+		return memequal(a, b, keySize)
+	}
+}
+
+func hashmapBinaryHash(ptr unsafe.Pointer, size uintptr) uint32 {
+	return hashmapHash(unsafe.Slice((*byte)(ptr), size))
+}
+
+// hashmapStringGet, hashmapStringSet and hashmapStringDelete are the map
+// operations for string keys: equality and hashing both work on the
+// string's bytes rather than on the (pointer, length) header itself.
+func hashmapStringGet(m *hashmap, key string, valuePtr unsafe.Pointer) bool {
+	keyPtr := unsafe.Pointer(&key)
+	return hashmapGet(m, keyPtr, valuePtr, hashmapStringEqual, hashmapStringHash)
+}
+
+func hashmapStringSet(m *hashmap, key string, valuePtr unsafe.Pointer) {
+	keyPtr := unsafe.Pointer(&key)
+	hashmapSet(m, keyPtr, valuePtr, hashmapStringEqual, hashmapStringHash)
+}
+
+func hashmapStringDelete(m *hashmap, key string) {
+	keyPtr := unsafe.Pointer(&key)
+	hashmapDelete(m, keyPtr, hashmapStringEqual, hashmapStringHash)
+}
+
+func hashmapStringEqual(a, b unsafe.Pointer) bool {
+	return *(*string)(a) == *(*string)(b)
+}
+
+func hashmapStringHash(ptr unsafe.Pointer, size uintptr) uint32 {
+	return hashmapHash([]byte(*(*string)(ptr)))
+}
+
+// hashmapHashString hashes a string value directly, for use by
+// compiler-generated hash thunks that already have the string loaded
+// (e.g. a string field nested inside a struct map key). See
+// compiler/mapkeys.go.
+func hashmapHashString(s string) uint32 {
+	return hashmapHash([]byte(s))
+}
+
+// hashmapHashInterface hashes an interface value for use as part of a map
+// key, by hashing its dynamic type only. This is coarser than hashing the
+// value as well, but interfaceEqual (used for the matching equality check)
+// always does a full, correct comparison, so a coarser hash only costs a
+// few extra equality checks on collision, never correctness.
+func hashmapHashInterface(x interface{}) uint32 {
+	typecode, _ := decomposeInterface(x)
+	return hashmapHash(unsafe.Slice((*byte)(unsafe.Pointer(&typecode)), unsafe.Sizeof(typecode)))
+}